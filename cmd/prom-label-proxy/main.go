@@ -0,0 +1,103 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	"github.com/opsgy/prom-label-proxy/injectproxy"
+)
+
+func main() {
+	var (
+		insecureListenAddress string
+		upstream              string
+		label                 string
+		labelLocation         string
+		configFile            string
+		corsOriginRegexp      string
+	)
+	flag.StringVar(&insecureListenAddress, "insecure-listen-address", ":8080", "The address the proxy listens on.")
+	flag.StringVar(&upstream, "upstream", "", "The upstream Prometheus/Thanos URL to proxy to.")
+	flag.StringVar(&label, "label", "", "The label to enforce in all proxied requests. Ignored if -config-file is set.")
+	flag.StringVar(&labelLocation, "label-location", "query", `Where to read the label value from: "query" (a query parameter) or "header". Ignored if -config-file is set.`)
+	flag.StringVar(&configFile, "config-file", "", "Path to a JSON file describing the label enforcements to apply, for composing more than one tenant dimension or a resolver other than query/header. Takes precedence over -label/-label-location.")
+	flag.StringVar(&corsOriginRegexp, "web.cors.origin", "", `Regexp for the allowed CORS origin; if unset, CORS handling is disabled.`)
+	flag.Parse()
+
+	if upstream == "" {
+		log.Fatal("-upstream is required")
+	}
+
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		log.Fatalf("invalid -upstream: %v", err)
+	}
+
+	enforcements, err := labelEnforcements(configFile, label, labelLocation)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	r := injectproxy.NewRoutes(upstreamURL, enforcements...)
+
+	if corsOriginRegexp != "" {
+		// Anchor the operator-supplied pattern so it must match the whole
+		// Origin header, not merely appear somewhere inside it -- otherwise
+		// an unanchored pattern like "https://grafana\.example\.com" would
+		// also accept "https://evil.example/https://grafana.example.com".
+		origin, err := regexp.Compile("^(?:" + corsOriginRegexp + ")$")
+		if err != nil {
+			log.Fatalf("invalid -web.cors.origin: %v", err)
+		}
+		r.SetCORSOrigin(origin)
+	}
+
+	log.Fatal(http.ListenAndServe(insecureListenAddress, r))
+}
+
+// labelEnforcements builds the []LabelEnforcement NewRoutes needs, either
+// from a config file (when configFile is set) or from the single -label/
+// -label-location flag pair.
+func labelEnforcements(configFile, label, labelLocation string) ([]injectproxy.LabelEnforcement, error) {
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading -config-file: %w", err)
+		}
+		return injectproxy.LoadConfig(data)
+	}
+
+	if label == "" {
+		return nil, fmt.Errorf("-label is required unless -config-file is set")
+	}
+
+	var resolver injectproxy.TenantResolver
+	switch labelLocation {
+	case "header":
+		resolver = injectproxy.HeaderResolver{Header: label}
+	case "query":
+		resolver = injectproxy.QueryParamResolver{Param: label}
+	default:
+		return nil, fmt.Errorf("invalid -label-location %q: must be \"query\" or \"header\"", labelLocation)
+	}
+
+	return []injectproxy.LabelEnforcement{{Label: label, Resolver: resolver}}, nil
+}
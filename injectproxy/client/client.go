@@ -0,0 +1,165 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client provides a Go client for talking to a prom-label-proxy
+// instance without going through an extra HTTP hop for the tenant label
+// itself: every request is pre-stamped with the configured label/value pair,
+// the same way the proxy's own reverse-proxy handlers would have rewritten
+// it.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Error is returned by Client methods instead of a bare error so that
+// callers who only check `err != nil` don't silently drop upstream
+// warnings that were attached to a partial/degraded response.
+type Error interface {
+	error
+	// Warnings returns any warnings the upstream Prometheus returned
+	// alongside the error, if any.
+	Warnings() []string
+}
+
+type apiError struct {
+	err      error
+	warnings []string
+}
+
+func (e *apiError) Error() string      { return e.err.Error() }
+func (e *apiError) Unwrap() error      { return e.err }
+func (e *apiError) Warnings() []string { return e.warnings }
+
+func wrapError(err error, warnings v1.Warnings) error {
+	if err == nil {
+		return nil
+	}
+	return &apiError{err: err, warnings: []string(warnings)}
+}
+
+// tenantRoundTripper injects the configured label value into every outgoing
+// request, either as a query parameter or a header, mirroring the proxy's
+// -label-location flag.
+type tenantRoundTripper struct {
+	label         string
+	value         string
+	labelLocation string
+	next          http.RoundTripper
+}
+
+func (t *tenantRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	if t.labelLocation == "header" {
+		req.Header.Set(t.label, t.value)
+	} else {
+		q := req.URL.Query()
+		q.Set(t.label, t.value)
+		req.URL.RawQuery = q.Encode()
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// Client is a tenant-scoped wrapper around the Prometheus v1 API client. It
+// implements the subset of v1.API that prom-label-proxy enforces, plus
+// Silences which the proxy forwards to Alertmanager's v2 API.
+type Client struct {
+	raw api.Client
+	api v1.API
+}
+
+// NewClient returns a Client that talks to the prom-label-proxy instance at
+// upstream, automatically attaching label=value to every request via
+// labelLocation ("query" or "header").
+func NewClient(upstream *url.URL, label, value, labelLocation string) (*Client, error) {
+	c, err := api.NewClient(api.Config{
+		Address: upstream.String(),
+		RoundTripper: &tenantRoundTripper{
+			label:         label,
+			value:         value,
+			labelLocation: labelLocation,
+			next:          api.DefaultRoundTripper,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{raw: c, api: v1.NewAPI(c)}, nil
+}
+
+func (c *Client) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	val, warnings, err := c.api.Query(ctx, query, ts)
+	return val, warnings, wrapError(err, warnings)
+}
+
+func (c *Client) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	val, warnings, err := c.api.QueryRange(ctx, query, r)
+	return val, warnings, wrapError(err, warnings)
+}
+
+func (c *Client) Series(ctx context.Context, matches []string, startTime, endTime time.Time) ([]model.LabelSet, v1.Warnings, error) {
+	series, warnings, err := c.api.Series(ctx, matches, startTime, endTime)
+	return series, warnings, wrapError(err, warnings)
+}
+
+func (c *Client) LabelNames(ctx context.Context, matches []string, startTime, endTime time.Time) ([]string, v1.Warnings, error) {
+	names, warnings, err := c.api.LabelNames(ctx, matches, startTime, endTime)
+	return names, warnings, wrapError(err, warnings)
+}
+
+func (c *Client) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time) (model.LabelValues, v1.Warnings, error) {
+	values, warnings, err := c.api.LabelValues(ctx, label, matches, startTime, endTime)
+	return values, warnings, wrapError(err, warnings)
+}
+
+func (c *Client) Alerts(ctx context.Context) (v1.AlertsResult, error) {
+	result, err := c.api.Alerts(ctx)
+	return result, wrapError(err, nil)
+}
+
+func (c *Client) Rules(ctx context.Context) (v1.RulesResult, error) {
+	result, err := c.api.Rules(ctx)
+	return result, wrapError(err, nil)
+}
+
+// Silences fetches the Alertmanager silences visible to the tenant. Unlike
+// the other methods it isn't part of v1.API, since silences are served by
+// Alertmanager's own v2 API; the result is decoded into dst the same way
+// json.Unmarshal would.
+func (c *Client) Silences(ctx context.Context, dst interface{}) error {
+	u := c.raw.URL("/api/v2/silences", nil)
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return wrapError(err, nil)
+	}
+	req = req.WithContext(ctx)
+
+	_, body, err := c.raw.Do(ctx, req)
+	if err != nil {
+		return wrapError(err, nil)
+	}
+
+	return wrapError(json.Unmarshal(body, dst), nil)
+}
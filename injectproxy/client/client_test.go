@@ -0,0 +1,102 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTenantRoundTripperQueryParam(t *testing.T) {
+	var gotReq *http.Request
+	rt := &tenantRoundTripper{
+		label:         "namespace",
+		value:         "tenant-a",
+		labelLocation: "query",
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://upstream/api/v1/query?query=up", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := gotReq.URL.Query().Get("namespace"); got != "tenant-a" {
+		t.Fatalf("expected namespace=tenant-a in the query, got %q", got)
+	}
+	if gotReq.Header.Get("namespace") != "" {
+		t.Fatalf("expected no header to be set, got %q", gotReq.Header.Get("namespace"))
+	}
+}
+
+func TestTenantRoundTripperHeader(t *testing.T) {
+	var gotReq *http.Request
+	rt := &tenantRoundTripper{
+		label:         "namespace",
+		value:         "tenant-a",
+		labelLocation: "header",
+		next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			gotReq = req
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://upstream/api/v1/query?query=up", nil)
+	if _, err := rt.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := gotReq.Header.Get("namespace"); got != "tenant-a" {
+		t.Fatalf("expected namespace header to be tenant-a, got %q", got)
+	}
+	if gotReq.URL.Query().Get("namespace") != "" {
+		t.Fatalf("expected no query param to be set, got %q", gotReq.URL.Query().Get("namespace"))
+	}
+}
+
+func TestWrapErrorWarnings(t *testing.T) {
+	base := errors.New("boom")
+	warnings := v1.Warnings{"careful"}
+
+	err := wrapError(base, warnings)
+	if err == nil {
+		t.Fatal("expected a non-nil error")
+	}
+
+	apiErr, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected an Error, got %T", err)
+	}
+	if got := apiErr.Warnings(); len(got) != 1 || got[0] != "careful" {
+		t.Fatalf("expected warnings to survive, got %v", got)
+	}
+	if apiErr.Error() != base.Error() {
+		t.Fatalf("expected the wrapped error message, got %q", apiErr.Error())
+	}
+
+	if wrapError(nil, warnings) != nil {
+		t.Fatal("expected wrapError(nil, ...) to return nil")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+)
+
+// ResolverConfig is the config-file representation of a TenantResolver: Type
+// selects which implementation to build, and the remaining fields configure
+// it (only the ones relevant to Type need to be set).
+type ResolverConfig struct {
+	Type string `json:"type"`
+
+	Param       string `json:"param,omitempty"`
+	Header      string `json:"header,omitempty"`
+	Claim       string `json:"claim,omitempty"`
+	UserInfoURL string `json:"userInfoURL,omitempty"`
+
+	// HMACSecret and RSAPublicKey verify a "jwt" resolver's token signature;
+	// exactly one must be set. HMACSecret is base64-encoded (std encoding),
+	// RSAPublicKey is a PEM-encoded PKIX public key.
+	HMACSecret   string `json:"hmacSecret,omitempty"`
+	RSAPublicKey string `json:"rsaPublicKey,omitempty"`
+}
+
+// EnforcementConfig is the config-file representation of a LabelEnforcement.
+type EnforcementConfig struct {
+	Label    string         `json:"label"`
+	Resolver ResolverConfig `json:"resolver"`
+}
+
+// Config is the top-level config-file shape accepted by LoadConfig, letting
+// operators combine multiple tenant dimensions without writing Go, e.g.
+// "namespace" resolved from a JWT claim and "cluster" resolved from a
+// header.
+type Config struct {
+	Enforcements []EnforcementConfig `json:"enforcements"`
+}
+
+// LoadConfig parses a JSON config file into the []LabelEnforcement NewRoutes
+// expects.
+func LoadConfig(data []byte) ([]LabelEnforcement, error) {
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	enforcements := make([]LabelEnforcement, 0, len(cfg.Enforcements))
+	for _, e := range cfg.Enforcements {
+		if e.Label == "" {
+			return nil, fmt.Errorf("enforcement is missing a \"label\"")
+		}
+
+		resolver, err := buildResolver(e.Resolver)
+		if err != nil {
+			return nil, fmt.Errorf("label %q: %w", e.Label, err)
+		}
+
+		enforcements = append(enforcements, LabelEnforcement{Label: e.Label, Resolver: resolver})
+	}
+	return enforcements, nil
+}
+
+func buildResolver(c ResolverConfig) (TenantResolver, error) {
+	switch c.Type {
+	case "query":
+		if c.Param == "" {
+			return nil, fmt.Errorf("resolver type %q requires \"param\"", c.Type)
+		}
+		return QueryParamResolver{Param: c.Param}, nil
+	case "header":
+		if c.Header == "" {
+			return nil, fmt.Errorf("resolver type %q requires \"header\"", c.Type)
+		}
+		return HeaderResolver{Header: c.Header}, nil
+	case "jwt":
+		if c.Claim == "" {
+			return nil, fmt.Errorf("resolver type %q requires \"claim\"", c.Type)
+		}
+		if c.HMACSecret != "" && c.RSAPublicKey != "" {
+			return nil, fmt.Errorf("resolver type %q accepts only one of \"hmacSecret\" or \"rsaPublicKey\"", c.Type)
+		}
+		switch {
+		case c.HMACSecret != "":
+			secret, err := base64.StdEncoding.DecodeString(c.HMACSecret)
+			if err != nil {
+				return nil, fmt.Errorf("resolver type %q: decoding \"hmacSecret\": %w", c.Type, err)
+			}
+			return JWTClaimResolver{Claim: c.Claim, HMACSecret: secret}, nil
+		case c.RSAPublicKey != "":
+			key, err := parseRSAPublicKeyPEM(c.RSAPublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("resolver type %q: parsing \"rsaPublicKey\": %w", c.Type, err)
+			}
+			return JWTClaimResolver{Claim: c.Claim, RSAPublicKey: key}, nil
+		default:
+			return nil, fmt.Errorf("resolver type %q requires \"hmacSecret\" or \"rsaPublicKey\" to verify the token signature", c.Type)
+		}
+	case "oidc":
+		if c.UserInfoURL == "" || c.Claim == "" {
+			return nil, fmt.Errorf("resolver type %q requires \"userInfoURL\" and \"claim\"", c.Type)
+		}
+		return OIDCUserInfoResolver{UserInfoURL: c.UserInfoURL, Claim: c.Claim}, nil
+	case "mtls":
+		return MTLSClientCertResolver{}, nil
+	default:
+		return nil, fmt.Errorf("unknown resolver type %q", c.Type)
+	}
+}
+
+// parseRSAPublicKeyPEM parses a PEM-encoded PKIX RSA public key, the format
+// produced by e.g. `openssl rsa -pubout`.
+func parseRSAPublicKeyPEM(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("not a PEM block")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+	return rsaKey, nil
+}
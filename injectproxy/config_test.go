@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("super-secret"))
+	data := []byte(`{
+		"enforcements": [
+			{"label": "namespace", "resolver": {"type": "jwt", "claim": "ns", "hmacSecret": "` + secret + `"}},
+			{"label": "cluster", "resolver": {"type": "header", "header": "X-Cluster"}}
+		]
+	}`)
+
+	enforcements, err := LoadConfig(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(enforcements) != 2 {
+		t.Fatalf("expected 2 enforcements, got %d", len(enforcements))
+	}
+	if enforcements[0].Label != "namespace" {
+		t.Fatalf("expected first enforcement to be namespace, got %q", enforcements[0].Label)
+	}
+	jwtResolver, ok := enforcements[0].Resolver.(JWTClaimResolver)
+	if !ok {
+		t.Fatalf("expected a JWTClaimResolver, got %T", enforcements[0].Resolver)
+	}
+	if string(jwtResolver.HMACSecret) != "super-secret" {
+		t.Fatalf("expected the decoded HMAC secret, got %q", jwtResolver.HMACSecret)
+	}
+	if enforcements[1].Label != "cluster" {
+		t.Fatalf("expected second enforcement to be cluster, got %q", enforcements[1].Label)
+	}
+	if _, ok := enforcements[1].Resolver.(HeaderResolver); !ok {
+		t.Fatalf("expected a HeaderResolver, got %T", enforcements[1].Resolver)
+	}
+}
+
+func TestLoadConfigJWTRequiresKey(t *testing.T) {
+	data := []byte(`{"enforcements": [{"label": "namespace", "resolver": {"type": "jwt", "claim": "ns"}}]}`)
+	if _, err := LoadConfig(data); err == nil {
+		t.Fatal("expected an error when neither hmacSecret nor rsaPublicKey is set")
+	}
+}
+
+func TestLoadConfigJWTRejectsBothKeys(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString([]byte("super-secret"))
+	data := []byte(`{"enforcements": [{"label": "namespace", "resolver": {
+		"type": "jwt", "claim": "ns", "hmacSecret": "` + secret + `", "rsaPublicKey": "bogus"
+	}}]}`)
+	if _, err := LoadConfig(data); err == nil {
+		t.Fatal("expected an error when both hmacSecret and rsaPublicKey are set")
+	}
+}
+
+func TestLoadConfigUnknownResolver(t *testing.T) {
+	data := []byte(`{"enforcements": [{"label": "namespace", "resolver": {"type": "bogus"}}]}`)
+	if _, err := LoadConfig(data); err == nil {
+		t.Fatal("expected an error for an unknown resolver type")
+	}
+}
+
+func TestLoadConfigMissingLabel(t *testing.T) {
+	data := []byte(`{"enforcements": [{"resolver": {"type": "header", "header": "X-Tenant"}}]}`)
+	if _, err := LoadConfig(data); err == nil {
+		t.Fatal("expected an error for a missing label")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const corsAllowHeaders = "Authorization, Content-Type"
+
+// SetCORSOrigin enables CORS handling: any request whose Origin header
+// matches origin gets Access-Control-Allow-* headers on its response, and an
+// OPTIONS preflight is answered directly without running tenant enforcement.
+// A nil origin (the default) disables CORS handling entirely. origin must be
+// anchored (e.g. "^https://grafana\.example\.com$") -- an unanchored pattern
+// would let an Origin that merely contains the pattern as a substring through
+// the allowlist.
+func (r *routes) SetCORSOrigin(origin *regexp.Regexp) {
+	r.corsOrigin = origin
+}
+
+// handleCORS sets the CORS response headers when the request's Origin
+// matches the configured regexp, and answers OPTIONS preflights on the
+// proxy's behalf. It reports whether it already wrote a response, in which
+// case the caller must not process the request any further.
+func (r *routes) handleCORS(w http.ResponseWriter, req *http.Request) bool {
+	if r.corsOrigin == nil {
+		return false
+	}
+
+	origin := req.Header.Get("Origin")
+	if origin == "" || !r.corsOrigin.MatchString(origin) {
+		return false
+	}
+
+	methods := r.methodsForPath(req.URL.Path)
+	if len(methods) == 0 {
+		methods = []string{http.MethodOptions}
+	} else {
+		methods = append(append([]string{}, methods...), http.MethodOptions)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+
+	if req.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// filterFederateResponse re-checks every sample in a /federate response
+// against the tenant's label matchers, in case match[] was ignored or a
+// recording rule produced a series with the label overridden. It replaces
+// resp.Body with a pipe fed by a goroutine that filters the exposition
+// format line by line as it's read, so a large federation payload never has
+// to be fully parsed or buffered before the first filtered byte is written.
+func (r *routes) filterFederateResponse(resp *http.Response) error {
+	req := resp.Request
+	src := resp.Body
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer src.Close()
+		pw.CloseWithError(streamFilterExposition(req, r, src, pw))
+	}()
+
+	resp.Body = pr
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+// expositionLabelPair matches a single `name="value"` label pair inside the
+// braces of a text-exposition sample line.
+var expositionLabelPair = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\]|\\.)*)"`)
+
+// streamFilterExposition copies the Prometheus text-exposition format from
+// src to dst one line at a time, dropping any sample line that doesn't
+// satisfy every one of r's enforcements. HELP/TYPE comments and blank lines
+// are always forwarded unchanged. Because it works line by line off a
+// buffered reader, filtered output starts flowing well before src is fully
+// consumed. OpenMetrics payloads pass through the same way: its sample lines
+// use the identical `name{labels} value` shape, and its "# EOF" terminator
+// is just another comment line that gets forwarded unchanged.
+func streamFilterExposition(req *http.Request, r *routes, src io.Reader, dst io.Writer) error {
+	br := bufio.NewReader(src)
+	bw := bufio.NewWriter(dst)
+
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 && keepExpositionLine(req, r, line) {
+			if _, werr := bw.WriteString(line); werr != nil {
+				return werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return bw.Flush()
+			}
+			return err
+		}
+	}
+}
+
+// keepExpositionLine reports whether a single line of the text-exposition
+// format should be forwarded to the tenant.
+func keepExpositionLine(req *http.Request, r *routes, line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return true
+	}
+	return labelsAllowed(req, r, exposedLabels(trimmed))
+}
+
+// exposedLabels extracts the label set out of a single exposition sample
+// line, e.g. `up{namespace="a",instance="b"} 1` -> {namespace: a, instance: b}.
+// A metric with no `{...}` block has no labels at all.
+func exposedLabels(line string) map[string]string {
+	start := strings.IndexByte(line, '{')
+	if start == -1 {
+		return nil
+	}
+
+	end := labelBlockEnd(line, start)
+	if end == -1 {
+		return nil
+	}
+
+	matches := expositionLabelPair.FindAllStringSubmatch(line[start+1:end], -1)
+	labels := make(map[string]string, len(matches))
+	for _, m := range matches {
+		labels[m[1]] = unescapeLabelValue(m[2])
+	}
+	return labels
+}
+
+// labelBlockEnd returns the index of the '}' that closes the label block
+// opened at line[start]. It tracks whether it's inside a quoted label value
+// so that a literal '}' in a value (e.g. `msg="error {nested}"`) doesn't
+// terminate the block early; `\"` and `\\` inside the value are skipped as
+// single escaped characters rather than treated as a closing quote.
+func labelBlockEnd(line string, start int) int {
+	inQuotes := false
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			if inQuotes {
+				i++
+			}
+		case '"':
+			inQuotes = !inQuotes
+		case '}':
+			if !inQuotes {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+var labelValueUnescaper = strings.NewReplacer(`\"`, `"`, `\n`, "\n", `\\`, `\`)
+
+func unescapeLabelValue(s string) string {
+	return labelValueUnescaper.Replace(s)
+}
+
+// labelsAllowed reports whether a label set satisfies every enforcement
+// configured on r.
+func labelsAllowed(req *http.Request, r *routes, labels map[string]string) bool {
+	for _, e := range r.enforcements {
+		value, ok := labels[e.Label]
+		if !ok {
+			return false
+		}
+
+		matched := false
+		for _, allowed := range mustLabelValue(req.Context(), e.Label) {
+			if value == allowed {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
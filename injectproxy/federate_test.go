@@ -0,0 +1,147 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func federateRoutes(tenant string) (*routes, *http.Request) {
+	r := &routes{
+		enforcements: []LabelEnforcement{
+			{Label: "namespace", Resolver: QueryParamResolver{Param: "namespace"}},
+		},
+	}
+	ctx := withLabelValues(context.Background(), map[string][]string{"namespace": {tenant}})
+	req := httptest.NewRequest(http.MethodGet, "/federate", nil).WithContext(ctx)
+	return r, req
+}
+
+func TestFilterFederateResponseDropsOtherTenants(t *testing.T) {
+	body := `# HELP up was the last scrape successful.
+# TYPE up gauge
+up{namespace="tenant-a",instance="a-1"} 1
+up{namespace="tenant-b",instance="b-1"} 1
+up{namespace="tenant-a",instance="a-2"} 0
+no_labels_at_all 1
+`
+	r, req := federateRoutes("tenant-a")
+
+	resp := &http.Response{
+		Request: req,
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+		Header:  make(http.Header),
+	}
+	if err := r.filterFederateResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+
+	if !strings.Contains(got, `instance="a-1"`) || !strings.Contains(got, `instance="a-2"`) {
+		t.Fatalf("expected tenant-a series to be kept, got:\n%s", got)
+	}
+	if strings.Contains(got, `instance="b-1"`) {
+		t.Fatalf("expected tenant-b series to be dropped, got:\n%s", got)
+	}
+	if strings.Contains(got, "no_labels_at_all") {
+		t.Fatalf("expected series missing the tenant label to be dropped, got:\n%s", got)
+	}
+	if !strings.Contains(got, "# HELP up") || !strings.Contains(got, "# TYPE up gauge") {
+		t.Fatalf("expected HELP/TYPE comments to be forwarded, got:\n%s", got)
+	}
+}
+
+func TestExposedLabelsToleratesBraceInValue(t *testing.T) {
+	labels := exposedLabels(`log{namespace="tenant-a",msg="error {nested} here"}`)
+	if labels["namespace"] != "tenant-a" {
+		t.Fatalf("expected namespace=tenant-a, got %v", labels)
+	}
+	if labels["msg"] != "error {nested} here" {
+		t.Fatalf("expected msg to keep its embedded braces, got %v", labels)
+	}
+}
+
+func TestFilterFederateResponseToleratesBraceInLabelValue(t *testing.T) {
+	body := `log{namespace="tenant-a",msg="error {nested} here"} 1
+log{namespace="tenant-b",msg="error {nested} here"} 1
+`
+	r, req := federateRoutes("tenant-a")
+
+	resp := &http.Response{
+		Request: req,
+		Body:    ioutil.NopCloser(strings.NewReader(body)),
+		Header:  make(http.Header),
+	}
+	if err := r.filterFederateResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(out)
+
+	if !strings.Contains(got, `namespace="tenant-a"`) {
+		t.Fatalf("expected the tenant-a series to survive a brace embedded in a label value, got:\n%s", got)
+	}
+	if strings.Contains(got, `namespace="tenant-b"`) {
+		t.Fatalf("expected the tenant-b series to be dropped, got:\n%s", got)
+	}
+}
+
+func exposition(n int) string {
+	var b strings.Builder
+	b.WriteString("# HELP up was the last scrape successful.\n# TYPE up gauge\n")
+	for i := 0; i < n; i++ {
+		tenant := "tenant-a"
+		if i%2 == 0 {
+			tenant = "tenant-b"
+		}
+		fmt.Fprintf(&b, "up{namespace=%q,instance=\"instance-%d\"} 1\n", tenant, i)
+	}
+	return b.String()
+}
+
+func BenchmarkFilterFederateResponse(b *testing.B) {
+	body := exposition(10000)
+	r, req := federateRoutes("tenant-a")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp := &http.Response{
+			Request: req,
+			Body:    ioutil.NopCloser(strings.NewReader(body)),
+			Header:  make(http.Header),
+		}
+		if err := r.filterFederateResponse(resp); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
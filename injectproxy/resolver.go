@@ -0,0 +1,267 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TenantResolver determines the tenant-supplied value(s) for a single label
+// out of an incoming request. Operators compose implementations via
+// LabelEnforcement to decide how each enforced label is attributed to a
+// request, instead of the proxy hard-coding "query param or header".
+type TenantResolver interface {
+	// Resolve returns the value(s) the request is scoped to for this
+	// label. It returns an error if the request doesn't carry a value at
+	// all, so routes.ServeHTTP can reject it uniformly.
+	Resolve(req *http.Request) ([]string, error)
+}
+
+// LabelEnforcement pairs a label name with the resolver used to determine
+// the tenant's allowed value(s) for it. A routes can be configured with
+// several of these to combine multiple tenant dimensions, e.g. "namespace"
+// resolved from a JWT claim and "cluster" resolved from a header.
+type LabelEnforcement struct {
+	Label    string
+	Resolver TenantResolver
+}
+
+// QueryParamResolver resolves the tenant value from a URL query parameter.
+type QueryParamResolver struct {
+	Param string
+}
+
+func (q QueryParamResolver) Resolve(req *http.Request) ([]string, error) {
+	value := req.URL.Query().Get(q.Param)
+	if value == "" {
+		return nil, fmt.Errorf("missing %q query parameter", q.Param)
+	}
+	return strings.Split(value, ","), nil
+}
+
+// HeaderResolver resolves the tenant value from a request header.
+type HeaderResolver struct {
+	Header string
+}
+
+func (h HeaderResolver) Resolve(req *http.Request) ([]string, error) {
+	value := req.Header.Get(h.Header)
+	if value == "" {
+		return nil, fmt.Errorf("missing %q header", h.Header)
+	}
+	return strings.Split(value, ","), nil
+}
+
+// JWTClaimResolver resolves the tenant value from a claim of the Bearer
+// token carried in the Authorization header. Since this proxy's entire job
+// is enforcing tenant isolation, it refuses to read a claim out of a token
+// whose signature it hasn't verified itself -- an unverified token would let
+// any client forge its own tenant value. Exactly one of HMACSecret or
+// RSAPublicKey must be set, matching the token's "alg" header (HS256 or
+// RS256 respectively).
+type JWTClaimResolver struct {
+	Claim string
+
+	// HMACSecret verifies an HS256-signed token.
+	HMACSecret []byte
+	// RSAPublicKey verifies an RS256-signed token.
+	RSAPublicKey *rsa.PublicKey
+}
+
+func (j JWTClaimResolver) Resolve(req *http.Request) ([]string, error) {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	token := strings.TrimPrefix(auth, prefix)
+
+	if err := verifyJWTSignature(token, j.HMACSecret, j.RSAPublicKey); err != nil {
+		return nil, fmt.Errorf("verifying bearer token: %w", err)
+	}
+
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		return nil, fmt.Errorf("decoding bearer token: %w", err)
+	}
+
+	return claimValues(claims, j.Claim)
+}
+
+// verifyJWTSignature checks token's signature against whichever of
+// hmacSecret/rsaKey is configured, matching the algorithm the token itself
+// declares in its header. It is an error to call it with neither key set,
+// so a JWTClaimResolver can never be used unverified by omission.
+func verifyJWTSignature(token string, hmacSecret []byte, rsaKey *rsa.PublicKey) error {
+	if len(hmacSecret) == 0 && rsaKey == nil {
+		return fmt.Errorf("no verification key configured")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("decoding header: %w", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return fmt.Errorf("parsing header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	signedInput := parts[0] + "." + parts[1]
+
+	switch header.Alg {
+	case "HS256":
+		if len(hmacSecret) == 0 {
+			return fmt.Errorf("token uses HS256 but no HMAC secret is configured")
+		}
+		mac := hmac.New(sha256.New, hmacSecret)
+		mac.Write([]byte(signedInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("signature mismatch")
+		}
+	case "RS256":
+		if rsaKey == nil {
+			return fmt.Errorf("token uses RS256 but no RSA public key is configured")
+		}
+		hashed := sha256.Sum256([]byte(signedInput))
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hashed[:], signature); err != nil {
+			return fmt.Errorf("signature verification failed: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	return nil
+}
+
+func decodeJWTClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func claimValues(claims map[string]interface{}, name string) ([]string, error) {
+	v, ok := claims[name]
+	if !ok {
+		return nil, fmt.Errorf("claim %q not present", name)
+	}
+
+	switch value := v.(type) {
+	case string:
+		return strings.Split(value, ","), nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %q contains a non-string value", name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim %q has unsupported type %T", name, v)
+	}
+}
+
+// OIDCUserInfoResolver resolves the tenant value by calling the OIDC
+// provider's userinfo endpoint with the incoming request's bearer token and
+// extracting a claim from the JSON it returns.
+type OIDCUserInfoResolver struct {
+	UserInfoURL string
+	Claim       string
+	Client      *http.Client
+}
+
+func (o OIDCUserInfoResolver) Resolve(req *http.Request) ([]string, error) {
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return nil, fmt.Errorf("missing Authorization header")
+	}
+
+	userInfoReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, o.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	userInfoReq.Header.Set("Authorization", auth)
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(userInfoReq)
+	if err != nil {
+		return nil, fmt.Errorf("calling userinfo endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo endpoint returned %s", resp.Status)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("decoding userinfo response: %w", err)
+	}
+
+	return claimValues(claims, o.Claim)
+}
+
+// MTLSClientCertResolver resolves the tenant value from the common name of
+// the client certificate used to establish the TLS connection.
+type MTLSClientCertResolver struct{}
+
+func (MTLSClientCertResolver) Resolve(req *http.Request) ([]string, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no client certificate presented")
+	}
+
+	cn := req.TLS.PeerCertificates[0].Subject.CommonName
+	if cn == "" {
+		return nil, fmt.Errorf("client certificate has no common name")
+	}
+
+	return []string{cn}, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// jwtWithClaims returns an HS256 token signed with secret, so tests can
+// exercise JWTClaimResolver's mandatory signature verification.
+func jwtWithClaims(t *testing.T, claimsJSON string, secret []byte) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claimsJSON))
+	signedInput := header + "." + payload
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signedInput))
+	signature := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	return signedInput + "." + signature
+}
+
+func unsignedJWTWithClaims(claimsJSON string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claimsJSON))
+	return header + "." + payload + ".sig"
+}
+
+func TestDecodeJWTClaims(t *testing.T) {
+	token := unsignedJWTWithClaims(`{"ns":"tenant-a"}`)
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims["ns"] != "tenant-a" {
+		t.Fatalf("expected claim ns=tenant-a, got %v", claims["ns"])
+	}
+}
+
+func TestDecodeJWTClaimsMalformed(t *testing.T) {
+	for _, token := range []string{"", "not-a-jwt", "a.b", "a.!!!.c"} {
+		if _, err := decodeJWTClaims(token); err == nil {
+			t.Fatalf("expected an error for malformed token %q", token)
+		}
+	}
+}
+
+func TestClaimValues(t *testing.T) {
+	cases := []struct {
+		name    string
+		claims  map[string]interface{}
+		claim   string
+		want    []string
+		wantErr bool
+	}{
+		{"string", map[string]interface{}{"ns": "tenant-a,tenant-b"}, "ns", []string{"tenant-a", "tenant-b"}, false},
+		{"string slice", map[string]interface{}{"ns": []interface{}{"a", "b"}}, "ns", []string{"a", "b"}, false},
+		{"missing", map[string]interface{}{}, "ns", nil, true},
+		{"wrong type", map[string]interface{}{"ns": 42}, "ns", nil, true},
+		{"non-string slice element", map[string]interface{}{"ns": []interface{}{"a", 1}}, "ns", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := claimValues(c.claims, c.claim)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("expected %v, got %v", c.want, got)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("expected %v, got %v", c.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestJWTClaimResolver(t *testing.T) {
+	secret := []byte("test-secret")
+	resolver := JWTClaimResolver{Claim: "ns", HMACSecret: secret}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+jwtWithClaims(t, `{"ns":"tenant-a"}`, secret))
+	values, err := resolver.Resolve(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 1 || values[0] != "tenant-a" {
+		t.Fatalf("expected [tenant-a], got %v", values)
+	}
+
+	reqNoAuth := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := resolver.Resolve(reqNoAuth); err == nil {
+		t.Fatal("expected an error when the Authorization header is missing")
+	}
+
+	reqWrongSecret := httptest.NewRequest(http.MethodGet, "/", nil)
+	reqWrongSecret.Header.Set("Authorization", "Bearer "+jwtWithClaims(t, `{"ns":"tenant-a"}`, []byte("wrong-secret")))
+	if _, err := resolver.Resolve(reqWrongSecret); err == nil {
+		t.Fatal("expected an error for a token signed with the wrong secret")
+	}
+
+	reqUnsigned := httptest.NewRequest(http.MethodGet, "/", nil)
+	reqUnsigned.Header.Set("Authorization", "Bearer "+unsignedJWTWithClaims(`{"ns":"tenant-a"}`))
+	if _, err := resolver.Resolve(reqUnsigned); err == nil {
+		t.Fatal("expected an error for an unsigned token")
+	}
+
+	unconfigured := JWTClaimResolver{Claim: "ns"}
+	reqAnySignature := httptest.NewRequest(http.MethodGet, "/", nil)
+	reqAnySignature.Header.Set("Authorization", "Bearer "+jwtWithClaims(t, `{"ns":"tenant-a"}`, secret))
+	if _, err := unconfigured.Resolve(reqAnySignature); err == nil {
+		t.Fatal("expected an error when no verification key is configured")
+	}
+}
+
+func TestOIDCUserInfoResolver(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ns":"tenant-a"}`))
+	}))
+	defer server.Close()
+
+	resolver := OIDCUserInfoResolver{UserInfoURL: server.URL, Claim: "ns"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer good-token")
+	values, err := resolver.Resolve(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 1 || values[0] != "tenant-a" {
+		t.Fatalf("expected [tenant-a], got %v", values)
+	}
+
+	reqBadToken := httptest.NewRequest(http.MethodGet, "/", nil)
+	reqBadToken.Header.Set("Authorization", "Bearer bad-token")
+	if _, err := resolver.Resolve(reqBadToken); err == nil {
+		t.Fatal("expected an error for a rejected token")
+	}
+
+	reqNoAuth := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := resolver.Resolve(reqNoAuth); err == nil {
+		t.Fatal("expected an error when the Authorization header is missing")
+	}
+}
+
+func TestMTLSClientCertResolver(t *testing.T) {
+	resolver := MTLSClientCertResolver{}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: "tenant-a"}},
+		},
+	}
+	values, err := resolver.Resolve(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(values) != 1 || values[0] != "tenant-a" {
+		t.Fatalf("expected [tenant-a], got %v", values)
+	}
+
+	reqNoCert := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := resolver.Resolve(reqNoCert); err == nil {
+		t.Fatal("expected an error when no client certificate was presented")
+	}
+}
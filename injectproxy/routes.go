@@ -15,10 +15,12 @@ package injectproxy
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/prometheus/prometheus/pkg/labels"
@@ -26,69 +28,109 @@ import (
 )
 
 type routes struct {
-	upstream      *url.URL
-	handler       http.Handler
-	label         string
-	labelLocation string
-	mux           *http.ServeMux
-	modifiers     map[string]func(*http.Response) error
+	upstream         *url.URL
+	handler          http.Handler
+	upstreamClient   *http.Client
+	enforcements     []LabelEnforcement
+	mux              *http.ServeMux
+	modifiers        map[string]func(*http.Response) error
+	corsOrigin       *regexp.Regexp
+	methodsByPattern map[string][]string
 }
 
-func NewRoutes(upstream *url.URL, label string, labelLocation string) *routes {
+// NewRoutes builds a reverse proxy that enforces every given LabelEnforcement
+// on requests to upstream. Operators combine multiple enforcements to scope
+// a request along more than one tenant dimension, e.g. "namespace" resolved
+// from a JWT claim and "cluster" resolved from a header.
+func NewRoutes(upstream *url.URL, enforcements ...LabelEnforcement) *routes {
 	proxy := httputil.NewSingleHostReverseProxy(upstream)
 
 	r := &routes{
-		upstream:      upstream,
-		handler:       proxy,
-		label:         label,
-		labelLocation: labelLocation,
-	}
-	mux := http.NewServeMux()
-	mux.Handle("/federate", enforceMethods(r.federate, "GET"))
-	mux.Handle("/api/v1/query", enforceMethods(r.query, "GET", "POST"))
-	mux.Handle("/api/v1/query_range", enforceMethods(r.query, "GET", "POST"))
-	mux.Handle("/api/v1/series", enforceMethods(r.series, "GET", "POST"))
-	mux.Handle("/api/v1/labels", enforceMethods(r.noop, "GET"))
-	mux.Handle("/api/v1/label/__name__/values", enforceMethods(r.noop, "GET"))
-	mux.Handle("/api/v1/alerts", enforceMethods(r.noop, "GET"))
-	mux.Handle("/api/v1/rules", enforceMethods(r.noop, "GET"))
-	mux.Handle("/api/v2/silences", enforceMethods(r.silences, "GET", "POST"))
-	mux.Handle("/api/v2/silences/", enforceMethods(r.silences, "GET", "POST"))
-	mux.Handle("/api/v2/silence/", enforceMethods(r.deleteSilence, "DELETE"))
-	r.mux = mux
+		upstream:         upstream,
+		handler:          proxy,
+		upstreamClient:   &http.Client{Transport: proxy.Transport},
+		enforcements:     enforcements,
+		methodsByPattern: map[string][]string{},
+	}
+	r.mux = http.NewServeMux()
+	r.handle("/federate", r.federate, "GET")
+	r.handle("/api/v1/query", r.query, "GET", "POST")
+	r.handle("/api/v1/query_range", r.query, "GET", "POST")
+	r.handle("/api/v1/query_exemplars", r.query, "GET", "POST")
+	r.handle("/api/v1/series", r.series, "GET", "POST")
+	r.handle("/api/v1/labels", r.labelNames, "GET", "POST")
+	r.handle("/api/v1/label/", r.labelValues, "GET")
+	r.handle("/api/v1/alerts", r.noop, "GET")
+	r.handle("/api/v1/rules", r.noop, "GET")
+	r.handle("/api/v1/metadata", r.noop, "GET")
+	r.handle("/api/v1/targets", r.noop, "GET")
+	r.handle("/api/v1/targets/metadata", r.targetsMetadata, "GET")
+	// Only the status subpaths that report server-wide, non-tenant-scoped
+	// information are exposed. /api/v1/status/config and .../flags are
+	// deliberately left unregistered (and so 404): config includes every
+	// tenant's scrape jobs and remote_write/remote_read endpoints (which can
+	// carry credentials in their URLs), and flags can leak upstream
+	// deployment details no single tenant should see.
+	r.handle("/api/v1/status/buildinfo", r.noop, "GET")
+	r.handle("/api/v1/status/runtimeinfo", r.noop, "GET")
+	r.handle("/api/v1/status/tsdb", r.noop, "GET")
+	r.handle("/api/v1/status/walreplay", r.noop, "GET")
+	r.handle("/api/v1/write", r.write, "POST")
+	r.handle("/api/v2/silences", r.silences, "GET", "POST")
+	r.handle("/api/v2/silences/", r.silences, "GET", "POST")
+	r.handle("/api/v2/silence/", r.deleteSilence, "DELETE")
 	r.modifiers = map[string]func(*http.Response) error{
-		"/api/v1/rules":  modifyAPIResponse(r.filterRules),
-		"/api/v1/alerts": modifyAPIResponse(r.filterAlerts),
+		"/federate":                r.filterFederateResponse,
+		"/api/v1/rules":            modifyAPIResponse(r.filterRules),
+		"/api/v1/alerts":           modifyAPIResponse(r.filterAlerts),
+		"/api/v1/labels":           modifyAPIResponse(r.filterLabelNames),
+		"/api/v1/metadata":         modifyAPIResponse(r.filterMetadata),
+		"/api/v1/targets":          modifyAPIResponse(r.filterTargets),
+		"/api/v1/targets/metadata": modifyAPIResponse(r.filterTargetsMetadata),
 	}
 	proxy.ModifyResponse = r.ModifyResponse
 	return r
 }
 
 func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	var lvalue string
-	if r.labelLocation == "header" {
-		lvalue = req.Header.Get(r.label)
-	} else {
-	  lvalue = req.URL.Query().Get(r.label)
-	}
-	if lvalue == "" {
-		http.Error(w, fmt.Sprintf("Bad request. The %q query parameter must be provided.", r.label), http.StatusBadRequest)
+	if r.handleCORS(w, req) {
 		return
 	}
 
-	lvalues := strings.Split(lvalue, ",")
+	values := make(map[string][]string, len(r.enforcements))
+	for _, e := range r.enforcements {
+		lvalues, err := e.Resolver.Resolve(req)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Bad request. Couldn't determine the value of %q: %s", e.Label, err), http.StatusBadRequest)
+			return
+		}
+		values[e.Label] = lvalues
+	}
 
-	req = req.WithContext(withLabelValue(req.Context(), lvalues))
-	// Remove the proxy label from the query parameters.
+	req = req.WithContext(withLabelValues(req.Context(), values))
+
+	// A resolver may have read the label out of a query parameter; strip it
+	// so the upstream doesn't see it as a regular query selector.
 	q := req.URL.Query()
-	q.Del(r.label)
+	for _, e := range r.enforcements {
+		q.Del(e.Label)
+		if qp, ok := e.Resolver.(QueryParamResolver); ok {
+			q.Del(qp.Param)
+		}
+	}
 	req.URL.RawQuery = q.Encode()
 
 	r.mux.ServeHTTP(w, req)
 }
 
 func (r *routes) ModifyResponse(resp *http.Response) error {
-	m, found := r.modifiers[resp.Request.URL.Path]
+	path := resp.Request.URL.Path
+
+	if name, ok := labelNameFromValuesPath(path); ok && r.hasLabel(name) {
+		return modifyAPIResponse(r.filterLabelValues)(resp)
+	}
+
+	m, found := r.modifiers[path]
 	if !found {
 		// Return the server's response unmodified.
 		return nil
@@ -96,6 +138,58 @@ func (r *routes) ModifyResponse(resp *http.Response) error {
 	return m(resp)
 }
 
+// hasLabel reports whether label is one of the labels this routes enforces.
+func (r *routes) hasLabel(label string) bool {
+	for _, e := range r.enforcements {
+		if e.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// matchers builds one label matcher per configured enforcement out of the
+// values resolved for this request.
+func (r *routes) matchers(ctx context.Context) []*labels.Matcher {
+	ms := make([]*labels.Matcher, 0, len(r.enforcements))
+	for _, e := range r.enforcements {
+		ms = append(ms, createLabelMatcher(ctx, e.Label))
+	}
+	return ms
+}
+
+// selector renders r.matchers as a single PromQL vector selector combining
+// every enforced label with logical AND.
+func (r *routes) selector(ctx context.Context) string {
+	return matchersToSelector(r.matchers(ctx))
+}
+
+// handle registers h on pattern for the given methods, same as
+// mux.Handle(pattern, enforceMethods(h, methods...)), while also recording
+// the pattern/methods pair so handleCORS can advertise the right
+// Access-Control-Allow-Methods for a given path.
+func (r *routes) handle(pattern string, h http.HandlerFunc, methods ...string) {
+	r.mux.Handle(pattern, enforceMethods(h, methods...))
+	r.methodsByPattern[pattern] = methods
+}
+
+// methodsForPath returns the methods registered for the pattern that
+// net/http's ServeMux would route path to: an exact match if one was
+// registered, otherwise the longest registered prefix ending in "/".
+func (r *routes) methodsForPath(path string) []string {
+	if methods, ok := r.methodsByPattern[path]; ok {
+		return methods
+	}
+
+	var best string
+	for pattern := range r.methodsByPattern {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	return r.methodsByPattern[best]
+}
+
 func enforceMethods(h http.HandlerFunc, methods ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		for _, m := range methods {
@@ -110,21 +204,25 @@ func enforceMethods(h http.HandlerFunc, methods ...string) http.Handler {
 
 type ctxKey int
 
-const keyLabel ctxKey = iota
+const keyLabelValues ctxKey = iota
 
-func mustLabelValue(ctx context.Context) []string {
-	lvalues, ok := ctx.Value(keyLabel).([]string)
+func mustLabelValue(ctx context.Context, label string) []string {
+	values, ok := ctx.Value(keyLabelValues).(map[string][]string)
+	if !ok {
+		panic("can't find the label values map in the context")
+	}
+	lvalues, ok := values[label]
 	if !ok {
-		panic(fmt.Sprintf("can't find the %q value in the context", keyLabel))
+		panic(fmt.Sprintf("can't find the %q value in the context", label))
 	}
 	if lvalues == nil || len(lvalues) == 0 {
-		panic(fmt.Sprintf("empty %q value in the context", keyLabel))
+		panic(fmt.Sprintf("empty %q value in the context", label))
 	}
 	return lvalues
 }
 
 func createLabelMatcher(ctx context.Context, label string) *labels.Matcher {
-	lvalues := mustLabelValue(ctx)
+	lvalues := mustLabelValue(ctx, label)
 
 	fmt.Println("label " + label + " should be: " + strings.Join(lvalues, ","))
 	if len(lvalues) == 1 {
@@ -143,8 +241,8 @@ func createLabelMatcher(ctx context.Context, label string) *labels.Matcher {
 	panic(fmt.Sprintf("label values has invalid size %d", len(lvalues)))
 }
 
-func withLabelValue(ctx context.Context, lvalues []string) context.Context {
-	return context.WithValue(ctx, keyLabel, lvalues)
+func withLabelValues(ctx context.Context, values map[string][]string) context.Context {
+	return context.WithValue(ctx, keyLabelValues, values)
 }
 
 func (r *routes) noop(w http.ResponseWriter, req *http.Request) {
@@ -157,9 +255,7 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	e := NewEnforcer([]*labels.Matcher{
-		createLabelMatcher(req.Context(), r.label),
-	}...)
+	e := NewEnforcer(r.matchers(req.Context())...)
 	if err := e.EnforceNode(expr); err != nil {
 		return
 	}
@@ -186,9 +282,7 @@ func (r *routes) series(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 
-			e := NewEnforcer([]*labels.Matcher{
-				createLabelMatcher(req.Context(), r.label),
-			}...)
+			e := NewEnforcer(r.matchers(req.Context())...)
 			if err := e.EnforceNode(expr); err != nil {
 				return
 			}
@@ -203,12 +297,311 @@ func (r *routes) series(w http.ResponseWriter, req *http.Request) {
 	r.handler.ServeHTTP(w, req)
 }
 
+// labelValuesPathPrefix and labelValuesPathSuffix bracket the label name in
+// a /api/v1/label/<name>/values request path.
+const (
+	labelValuesPathPrefix = "/api/v1/label/"
+	labelValuesPathSuffix = "/values"
+)
+
+// labelNameFromValuesPath extracts <name> from a /api/v1/label/<name>/values
+// request path. It reports false if the path doesn't match that shape.
+func labelNameFromValuesPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, labelValuesPathPrefix) || !strings.HasSuffix(path, labelValuesPathSuffix) {
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(path, labelValuesPathPrefix), labelValuesPathSuffix), true
+}
+
+// setMatchParam adds a match[] query parameter enforcing the tenant's label
+// matchers, keeping any match[] parameters the client already supplied.
+func (r *routes) setMatchParam(req *http.Request) {
+	q := req.URL.Query()
+	q.Add("match[]", r.selector(req.Context()))
+	req.URL.RawQuery = q.Encode()
+}
+
+func (r *routes) labelNames(w http.ResponseWriter, req *http.Request) {
+	r.setMatchParam(req)
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *routes) labelValues(w http.ResponseWriter, req *http.Request) {
+	if _, ok := labelNameFromValuesPath(req.URL.Path); !ok {
+		http.NotFound(w, req)
+		return
+	}
+	r.setMatchParam(req)
+	r.handler.ServeHTTP(w, req)
+}
+
 func (r *routes) federate(w http.ResponseWriter, req *http.Request) {
-	matcher := createLabelMatcher(req.Context(), r.label)
+	q := req.URL.Query()
+	q.Set("match[]", r.selector(req.Context()))
+	req.URL.RawQuery = q.Encode()
+
+	r.handler.ServeHTTP(w, req)
+}
 
+// matchersToSelector renders a set of matchers as a PromQL vector selector,
+// e.g. `{job="foo",instance=~"bar.*"}`.
+func matchersToSelector(matchers []*labels.Matcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, m.String())
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *routes) targetsMetadata(w http.ResponseWriter, req *http.Request) {
 	q := req.URL.Query()
-	q.Set("match[]", "{"+matcher.String()+"}")
+	matchTarget := q.Get("match_target")
+	if matchTarget == "" {
+		q.Set("match_target", r.selector(req.Context()))
+	} else {
+		matchers, err := parser.ParseMetricSelector(matchTarget)
+		if err != nil {
+			return
+		}
+		q.Set("match_target", matchersToSelector(append(matchers, r.matchers(req.Context())...)))
+	}
 	req.URL.RawQuery = q.Encode()
 
 	r.handler.ServeHTTP(w, req)
 }
+
+// allowedMetricNames asks the upstream for the series the tenant is allowed
+// to see and returns the set of their metric names, so that /api/v1/metadata
+// can be filtered down to metrics the tenant actually owns.
+func (r *routes) allowedMetricNames(req *http.Request) (map[string]struct{}, error) {
+	u := *r.upstream
+	u.Path = "/api/v1/series"
+	q := u.Query()
+	q.Set("match[]", r.selector(req.Context()))
+	u.RawQuery = q.Encode()
+
+	seriesReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Carry over the caller's credentials (bearer token, basic auth, any
+	// auth-relevant custom header) so this internal call authenticates
+	// against the upstream the same way the original request would have.
+	seriesReq.Header = req.Header.Clone()
+
+	resp, err := r.upstreamClient.Do(seriesReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sr struct {
+		Status string              `json:"status"`
+		Data   []map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(sr.Data))
+	for _, series := range sr.Data {
+		if name, ok := series["__name__"]; ok {
+			names[name] = struct{}{}
+		}
+	}
+	return names, nil
+}
+
+// filterMetadata drops any metric the tenant doesn't own from a
+// /api/v1/metadata response, in case the upstream doesn't scope metadata by
+// series ownership on its own.
+func (r *routes) filterMetadata(req *http.Request, body []byte) ([]byte, error) {
+	var mr struct {
+		Status    string                     `json:"status"`
+		Data      map[string]json.RawMessage `json:"data"`
+		ErrorType string                     `json:"errorType,omitempty"`
+		Error     string                     `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(body, &mr); err != nil {
+		return nil, err
+	}
+	if mr.Status != "success" {
+		return body, nil
+	}
+
+	names, err := r.allowedMetricNames(req)
+	if err != nil {
+		return nil, err
+	}
+	for name := range mr.Data {
+		if _, ok := names[name]; !ok {
+			delete(mr.Data, name)
+		}
+	}
+
+	return json.Marshal(mr)
+}
+
+// targetLabels is the subset of a target's JSON representation this proxy
+// needs in order to decide whether a tenant may see it.
+type targetLabels struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// targetAllowed reports whether a target's label set satisfies every
+// enforcement configured on r: each enforced label must be present on the
+// target and match one of the values resolved for this request.
+func (r *routes) targetAllowed(req *http.Request, labels map[string]string) bool {
+	for _, e := range r.enforcements {
+		value, ok := labels[e.Label]
+		if !ok {
+			return false
+		}
+
+		matched := false
+		for _, allowed := range mustLabelValue(req.Context(), e.Label) {
+			if value == allowed {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// filterTargets restricts a /api/v1/targets response to the active and
+// dropped targets that belong to the requesting tenant.
+func (r *routes) filterTargets(req *http.Request, body []byte) ([]byte, error) {
+	var tr struct {
+		Status string `json:"status"`
+		Data   struct {
+			ActiveTargets  []json.RawMessage `json:"activeTargets"`
+			DroppedTargets []json.RawMessage `json:"droppedTargets"`
+		} `json:"data"`
+		ErrorType string `json:"errorType,omitempty"`
+		Error     string `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, err
+	}
+	if tr.Status != "success" {
+		return body, nil
+	}
+
+	tr.Data.ActiveTargets = filterTargetsByLabel(req, r, tr.Data.ActiveTargets)
+	tr.Data.DroppedTargets = filterTargetsByLabel(req, r, tr.Data.DroppedTargets)
+
+	return json.Marshal(tr)
+}
+
+// filterTargetsMetadata restricts a /api/v1/targets/metadata response to
+// entries whose target belongs to the requesting tenant.
+func (r *routes) filterTargetsMetadata(req *http.Request, body []byte) ([]byte, error) {
+	var raw struct {
+		Status    string            `json:"status"`
+		Data      []json.RawMessage `json:"data"`
+		ErrorType string            `json:"errorType,omitempty"`
+		Error     string            `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if raw.Status != "success" {
+		return body, nil
+	}
+
+	filtered := raw.Data[:0]
+	for _, entry := range raw.Data {
+		var t struct {
+			Target targetLabels `json:"target"`
+		}
+		if err := json.Unmarshal(entry, &t); err != nil {
+			return nil, err
+		}
+		if r.targetAllowed(req, t.Target.Labels) {
+			filtered = append(filtered, entry)
+		}
+	}
+	raw.Data = filtered
+
+	return json.Marshal(raw)
+}
+
+func filterTargetsByLabel(req *http.Request, r *routes, targets []json.RawMessage) []json.RawMessage {
+	filtered := targets[:0]
+	for _, raw := range targets {
+		var t targetLabels
+		if err := json.Unmarshal(raw, &t); err != nil {
+			continue
+		}
+		if r.targetAllowed(req, t.Labels) {
+			filtered = append(filtered, raw)
+		}
+	}
+	return filtered
+}
+
+// namesAndValuesResponse is the shape of a successful /api/v1/labels or
+// /api/v1/label/<name>/values response.
+type namesAndValuesResponse struct {
+	Status    string   `json:"status"`
+	Data      []string `json:"data"`
+	ErrorType string   `json:"errorType,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// filterLabelNames strips the tenant label itself out of a /api/v1/labels
+// response, so that a tenant can't discover the name used to enforce
+// multi-tenancy even if the upstream ignored the injected match[].
+func (r *routes) filterLabelNames(req *http.Request, body []byte) ([]byte, error) {
+	var lr namesAndValuesResponse
+	if err := json.Unmarshal(body, &lr); err != nil {
+		return nil, err
+	}
+	if lr.Status != "success" {
+		return body, nil
+	}
+
+	filtered := lr.Data[:0]
+	for _, name := range lr.Data {
+		if !r.hasLabel(name) {
+			filtered = append(filtered, name)
+		}
+	}
+	lr.Data = filtered
+
+	return json.Marshal(lr)
+}
+
+// filterLabelValues restricts a /api/v1/label/<name>/values response to the
+// values the requesting tenant is allowed to see for that label, in case the
+// upstream ignored the injected match[].
+func (r *routes) filterLabelValues(req *http.Request, body []byte) ([]byte, error) {
+	var lr namesAndValuesResponse
+	if err := json.Unmarshal(body, &lr); err != nil {
+		return nil, err
+	}
+	if lr.Status != "success" {
+		return body, nil
+	}
+
+	name, _ := labelNameFromValuesPath(req.URL.Path)
+
+	allowed := make(map[string]struct{})
+	for _, v := range mustLabelValue(req.Context(), name) {
+		allowed[v] = struct{}{}
+	}
+
+	filtered := lr.Data[:0]
+	for _, value := range lr.Data {
+		if _, ok := allowed[value]; ok {
+			filtered = append(filtered, value)
+		}
+	}
+	lr.Data = filtered
+
+	return json.Marshal(lr)
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// write enforces every configured label on an incoming remote-write request:
+// a series that already carries an enforced label must agree with the
+// tenant value, otherwise the whole request is rejected; series missing a
+// label get it added. The (possibly rewritten) request is then re-encoded
+// and forwarded upstream.
+func (r *routes) write(w http.ResponseWriter, req *http.Request) {
+	tenant := make(map[string]string, len(r.enforcements))
+	for _, e := range r.enforcements {
+		lvalues := mustLabelValue(req.Context(), e.Label)
+		if len(lvalues) != 1 {
+			http.Error(w, fmt.Sprintf("write requests must be scoped to a single value of %q", e.Label), http.StatusBadRequest)
+			return
+		}
+		tenant[e.Label] = lvalues[0]
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, "failed to decode snappy body", http.StatusBadRequest)
+		return
+	}
+
+	var wreq prompb.WriteRequest
+	if err := proto.Unmarshal(body, &wreq); err != nil {
+		http.Error(w, "failed to unmarshal remote-write request", http.StatusBadRequest)
+		return
+	}
+
+	for i, ts := range wreq.Timeseries {
+		seen := make(map[string]bool, len(tenant))
+		for j, l := range ts.Labels {
+			value, ok := tenant[l.Name]
+			if !ok {
+				continue
+			}
+			seen[l.Name] = true
+			if l.Value != value {
+				http.Error(w, fmt.Sprintf("series label %q=%q does not match tenant %q", l.Name, l.Value, value), http.StatusForbidden)
+				return
+			}
+			ts.Labels[j] = l
+		}
+		for _, e := range r.enforcements {
+			if !seen[e.Label] {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: e.Label, Value: tenant[e.Label]})
+			}
+		}
+		wreq.Timeseries[i] = ts
+	}
+
+	out, err := proto.Marshal(&wreq)
+	if err != nil {
+		http.Error(w, "failed to marshal remote-write request", http.StatusInternalServerError)
+		return
+	}
+	encoded := snappy.Encode(nil, out)
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(encoded))
+	req.ContentLength = int64(len(encoded))
+	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(encoded)))
+
+	r.handler.ServeHTTP(w, req)
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package injectproxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func encodeWriteRequest(t *testing.T, wreq *prompb.WriteRequest) []byte {
+	t.Helper()
+	data, err := proto.Marshal(wreq)
+	if err != nil {
+		t.Fatalf("marshaling write request: %v", err)
+	}
+	return snappy.Encode(nil, data)
+}
+
+func decodeWriteRequest(t *testing.T, body []byte) *prompb.WriteRequest {
+	t.Helper()
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatalf("snappy decoding forwarded body: %v", err)
+	}
+	var wreq prompb.WriteRequest
+	if err := proto.Unmarshal(decoded, &wreq); err != nil {
+		t.Fatalf("unmarshaling forwarded write request: %v", err)
+	}
+	return &wreq
+}
+
+func TestWriteEnforcesTenantLabels(t *testing.T) {
+	cases := []struct {
+		name         string
+		enforcements []LabelEnforcement
+		values       map[string][]string
+		in           []prompb.TimeSeries
+		wantStatus   int
+		wantLabels   []map[string]string
+	}{
+		{
+			name:         "mismatched label is rejected",
+			enforcements: []LabelEnforcement{{Label: "namespace"}},
+			values:       map[string][]string{"namespace": {"tenant-a"}},
+			in: []prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "tenant-b"}}},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:         "missing label is appended",
+			enforcements: []LabelEnforcement{{Label: "namespace"}},
+			values:       map[string][]string{"namespace": {"tenant-a"}},
+			in: []prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+			},
+			wantStatus: http.StatusOK,
+			wantLabels: []map[string]string{
+				{"__name__": "up", "namespace": "tenant-a"},
+			},
+		},
+		{
+			name:         "multi-enforcement rejects if any label mismatches",
+			enforcements: []LabelEnforcement{{Label: "namespace"}, {Label: "cluster"}},
+			values:       map[string][]string{"namespace": {"tenant-a"}, "cluster": {"us-east"}},
+			in: []prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "namespace", Value: "tenant-a"}, {Name: "cluster", Value: "us-west"}}},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:         "multi-enforcement appends every missing label",
+			enforcements: []LabelEnforcement{{Label: "namespace"}, {Label: "cluster"}},
+			values:       map[string][]string{"namespace": {"tenant-a"}, "cluster": {"us-east"}},
+			in: []prompb.TimeSeries{
+				{Labels: []prompb.Label{{Name: "__name__", Value: "up"}}},
+			},
+			wantStatus: http.StatusOK,
+			wantLabels: []map[string]string{
+				{"__name__": "up", "namespace": "tenant-a", "cluster": "us-east"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var forwarded *prompb.WriteRequest
+			r := &routes{enforcements: c.enforcements}
+			r.handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Fatalf("reading forwarded body: %v", err)
+				}
+				forwarded = decodeWriteRequest(t, body)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			body := encodeWriteRequest(t, &prompb.WriteRequest{Timeseries: c.in})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(body))
+			req = req.WithContext(withLabelValues(context.Background(), c.values))
+
+			w := httptest.NewRecorder()
+			r.write(w, req)
+
+			if w.Code != c.wantStatus {
+				t.Fatalf("expected status %d, got %d (%s)", c.wantStatus, w.Code, w.Body.String())
+			}
+			if c.wantStatus != http.StatusOK {
+				return
+			}
+
+			if forwarded == nil {
+				t.Fatal("request was not forwarded upstream")
+			}
+			if len(forwarded.Timeseries) != len(c.wantLabels) {
+				t.Fatalf("expected %d series, got %d", len(c.wantLabels), len(forwarded.Timeseries))
+			}
+			for i, ts := range forwarded.Timeseries {
+				got := make(map[string]string, len(ts.Labels))
+				for _, l := range ts.Labels {
+					got[l.Name] = l.Value
+				}
+				want := c.wantLabels[i]
+				if len(got) != len(want) {
+					t.Fatalf("series %d: expected labels %v, got %v", i, want, got)
+				}
+				for k, v := range want {
+					if got[k] != v {
+						t.Fatalf("series %d: expected labels %v, got %v", i, want, got)
+					}
+				}
+			}
+		})
+	}
+}